@@ -33,13 +33,17 @@ func main() {
 		},
 	}
 
-	cmd.Flags().AddGoFlagSet(flag.CommandLine)
-	cmd.PersistentFlags().StringVar(&options.NodeID, "nodeid", "", "CSI node id")
-	_ = cmd.MarkPersistentFlagRequired("nodeid")
-	cmd.PersistentFlags().StringVar(&options.Endpoint, "endpoint", "", "CSI endpoint to connect to")
-	cmd.PersistentFlags().StringVar(&options.DriverName, "driver-name", "", "CSI driver name")
+	cmd.PersistentFlags().AddGoFlagSet(flag.CommandLine)
+	cmd.Flags().StringVar(&options.NodeID, "nodeid", "", "CSI node id")
+	_ = cmd.MarkFlagRequired("nodeid")
+	cmd.Flags().StringVar(&options.Endpoint, "endpoint", "", "CSI endpoint to connect to")
+	cmd.Flags().StringVar(&options.DriverName, "driver-name", "", "CSI driver name")
 	cmd.PersistentFlags().StringVar(&options.Kubeconfig, "kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
-	cmd.PersistentFlags().StringVar(&options.MetricsAddress, "metrics-address", "", "metrics address")
+	cmd.Flags().StringVar(&options.MetricsAddress, "metrics-address", "", "metrics address")
+	cmd.Flags().StringVar(&options.Zone, "zone", "", "topology zone reported by this node")
+	cmd.Flags().StringVar(&options.Rack, "rack", "", "topology rack reported by this node")
+
+	cmd.AddCommand(newMigrateCommand(&options.Kubeconfig))
 
 	if err := cmd.Execute(); err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "%s", err.Error())
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	gfd "github.com/gluster/gluster-csi-driver/pkg/glusterfs"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func newMigrateCommand(kubeconfig *string) *cobra.Command {
+	opts := &gfd.MigrateOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "migrate [PV...]",
+		Short: "Migrate in-tree kubernetes.io/glusterfs PVs to the GlusterFS CSI driver",
+		Long: `Translate PVs using the in-tree glusterfs plugin into PVs using this driver.
+The first address of the referenced Endpoints becomes the gluster server and
+the remaining ones the backup volfile servers. All in-tree glusterfs PVs are
+migrated unless PV names are given.
+
+By default the translated PVs are printed as YAML. With --dry-run a diff
+against the current PV is printed instead. With --apply each PV is replaced
+in the cluster, keeping its name and claim so the PVC is bound again; PVs
+whose claim is still used by a pod are skipped, and the pv-protection
+finalizer of the others is removed so they can be deleted while bound.
+Each translated PV is printed before the in-tree PV is deleted, so it can be
+applied by hand if creating it fails.
+Translated PVs always use the Retain reclaim policy.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.DryRun && opts.Apply {
+				return errors.New("--dry-run and --apply are mutually exclusive")
+			}
+			client, err := newKubeClient(*kubeconfig)
+			if err != nil {
+				return err
+			}
+			return gfd.MigrateInTreePVs(cmd.Context(), client, cmd.OutOrStdout(), opts, args)
+		},
+	}
+
+	cmd.Flags().BoolVar(&opts.DryRun, "dry-run", false, "print a diff between each in-tree PV and its translation")
+	cmd.Flags().BoolVar(&opts.Apply, "apply", false, "replace the in-tree PVs in the cluster with their translation")
+	cmd.Flags().DurationVar(&opts.Timeout, "timeout", 2*time.Minute, "time to wait for an in-tree PV to be deleted when applying")
+
+	return cmd
+}
+
+func newKubeClient(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build kubernetes config: %w", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
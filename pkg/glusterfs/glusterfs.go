@@ -19,6 +19,14 @@ const (
 	pvcNameMetadata      = "${pvc.metadata.name}"
 	pvcNamespaceMetadata = "${pvc.metadata.namespace}"
 	pvNameMetadata       = "${pv.metadata.name}"
+
+	glusterServerKey        = "glusterserver"
+	glusterVolumeKey        = "glustervol"
+	glusterSnapshotKey      = "glustersnapshot"
+	glusterBackupServersKey = "glusterbkpservers"
+
+	topologyZoneKey = "topology.gluster.org/zone"
+	topologyRackKey = "topology.gluster.org/rack"
 )
 
 type CSIDriver interface {
@@ -36,6 +44,7 @@ type Driver struct {
 	name     string
 	nodeID   string
 	version  string
+	topology map[string]string
 
 	ns    *NodeServer
 	nscap []*csi.NodeServiceCapability
@@ -47,6 +56,8 @@ type DriverOptions struct {
 	DriverName     string
 	Kubeconfig     string
 	MetricsAddress string
+	Zone           string
+	Rack           string
 }
 
 // New returns CSI driver
@@ -63,12 +74,19 @@ func NewDriver(options *DriverOptions) *Driver {
 		name:     options.DriverName,
 		version:  driverVersion,
 		nodeID:   options.NodeID,
+		topology: map[string]string{},
+	}
+
+	if options.Zone != "" {
+		gfd.topology[topologyZoneKey] = options.Zone
+	}
+	if options.Rack != "" {
+		gfd.topology[topologyRackKey] = options.Rack
 	}
 
+	// GET_VOLUME_STATS is left out until NodeGetVolumeStats is implemented
 	gfd.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
-		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
-		csi.NodeServiceCapability_RPC_UNKNOWN,
 	})
 
 	klog.V(1).Infof("GlusterFS CSI driver initialized")
@@ -99,6 +117,9 @@ func (g *Driver) Run(endpoint, kubeconfig string, testMode bool) {
 		mounter = mounter.(mount.MounterForceUnmounter)
 	}
 	g.ns = NewNodeServer(g, mounter)
+	if err := g.ns.loadPublishedPaths(); err != nil {
+		klog.Warningf("failed to load published volumes from the mount table: %v", err)
+	}
 	srv := NewNonBlockingGRPCServer()
 	srv.Start(g.endpoint, NewIdentityServer(g), nil, g.ns, testMode)
 	srv.Wait()
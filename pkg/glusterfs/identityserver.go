@@ -54,6 +54,17 @@ func (is *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.Ge
 			},
 		},
 	}
+	// topology is only advertised when NodeGetInfo has segments to report,
+	// so --zone and --rack must be set consistently on every node
+	if len(is.Driver.topology) > 0 {
+		resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		})
+	}
 	klog.V(1).Infof("plugin capability response: %+v", resp)
 	return resp, nil
 }
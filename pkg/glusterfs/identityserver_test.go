@@ -110,3 +110,16 @@ func TestGetPluginCapabilities(t *testing.T) {
 	assert.Equal(t, expectedCap, resp.Capabilities)
 
 }
+
+func TestGetPluginCapabilitiesWithTopology(t *testing.T) {
+	d := NewEmptyDriver("")
+	d.topology = map[string]string{topologyZoneKey: "zone-a"}
+	fakeIdentityServer := IdentityServer{
+		Driver: d,
+	}
+	req := csi.GetPluginCapabilitiesRequest{}
+	resp, err := fakeIdentityServer.GetPluginCapabilities(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Len(t, resp.Capabilities, 2)
+	assert.Equal(t, csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS, resp.Capabilities[1].GetService().GetType())
+}
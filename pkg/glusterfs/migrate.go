@@ -0,0 +1,372 @@
+package glusterfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	provisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+	pvProtectionFinalizer   = "kubernetes.io/pv-protection"
+)
+
+// MigrateOptions controls what MigrateInTreePVs does with each translated PV.
+// By default the translation is printed as YAML.
+type MigrateOptions struct {
+	// DryRun prints a diff between each in-tree PV and its translation.
+	DryRun bool
+	// Apply replaces the in-tree PVs in the cluster with their translation.
+	Apply bool
+	// Timeout bounds the wait for an in-tree PV to be deleted when applying.
+	Timeout time.Duration
+}
+
+// IsInTreeGlusterPV returns true if the PV uses the removed in-tree
+// kubernetes.io/glusterfs volume plugin.
+func IsInTreeGlusterPV(pv *v1.PersistentVolume) bool {
+	return pv != nil && pv.Spec.Glusterfs != nil
+}
+
+// InTreeEndpointsNamespace returns the namespace of the Endpoints object an
+// in-tree glusterfs PV refers to. Like the in-tree plugin, it falls back to
+// the namespace of the bound claim.
+func InTreeEndpointsNamespace(pv *v1.PersistentVolume) string {
+	if ns := pv.Spec.Glusterfs.EndpointsNamespace; ns != nil && *ns != "" {
+		return *ns
+	}
+	if pv.Spec.ClaimRef != nil {
+		return pv.Spec.ClaimRef.Namespace
+	}
+	return ""
+}
+
+// TranslateInTreePV returns a PV using this driver that is equivalent to the
+// given in-tree glusterfs PV. The first endpoint address becomes the
+// glusterserver and the remaining ones the backup volfile servers. The
+// translated PV always uses the Retain reclaim policy, since the driver does
+// not delete gluster volumes.
+func TranslateInTreePV(pv *v1.PersistentVolume, ep *v1.Endpoints) (*v1.PersistentVolume, error) {
+	if !IsInTreeGlusterPV(pv) {
+		return nil, fmt.Errorf("PV %s is not an in-tree glusterfs PV", pv.Name)
+	}
+	if ep == nil {
+		return nil, errors.New("endpoints must be provided")
+	}
+
+	// in-tree Endpoints usually carry one subset per port, so the same
+	// address can show up several times
+	var servers []string
+	seen := map[string]bool{}
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			// like the in-tree plugin only the IP is used, Hostname is a
+			// DNS label within a headless service
+			server := addr.IP
+			if server == "" || seen[server] {
+				continue
+			}
+			// backup-volfile-servers is colon separated and cannot hold
+			// IPv6 addresses
+			if ip := net.ParseIP(server); ip != nil && ip.To4() == nil {
+				return nil, fmt.Errorf("endpoints %s/%s of PV %s has IPv6 address %s, which is not supported", ep.Namespace, ep.Name, pv.Name, server)
+			}
+			seen[server] = true
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("endpoints %s/%s of PV %s has no addresses", ep.Namespace, ep.Name, pv.Name)
+	}
+
+	volume := strings.TrimPrefix(pv.Spec.Glusterfs.Path, "/")
+	if volume == "" {
+		return nil, fmt.Errorf("PV %s has an empty glusterfs path", pv.Name)
+	}
+
+	volCtx := map[string]string{
+		glusterServerKey: servers[0],
+		glusterVolumeKey: volume,
+	}
+	if len(servers) > 1 {
+		volCtx[glusterBackupServersKey] = strings.Join(servers[1:], ":")
+	}
+
+	out := pv.DeepCopy()
+	out.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"}
+	out.ObjectMeta = metav1.ObjectMeta{
+		Name:        out.Name,
+		Labels:      out.Labels,
+		Annotations: out.Annotations,
+	}
+	// the in-tree provisioner no longer exists to act on this PV
+	delete(out.Annotations, provisionedByAnnotation)
+	out.Status = v1.PersistentVolumeStatus{}
+	out.Spec.Glusterfs = nil
+	out.Spec.CSI = &v1.CSIPersistentVolumeSource{
+		Driver:           glusterfsCSIDriverName,
+		VolumeHandle:     pv.Name,
+		ReadOnly:         pv.Spec.Glusterfs.ReadOnly,
+		VolumeAttributes: volCtx,
+	}
+	out.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimRetain
+	if out.Spec.ClaimRef != nil {
+		out.Spec.ClaimRef.ResourceVersion = ""
+	}
+	return out, nil
+}
+
+// MigrateInTreePVs translates the named in-tree glusterfs PVs, or all of them
+// when no names are given, and prints, diffs or applies the result depending
+// on opts.
+func MigrateInTreePVs(ctx context.Context, client kubernetes.Interface, out io.Writer, opts *MigrateOptions, names []string) error {
+	if opts.DryRun && opts.Apply {
+		return errors.New("dry run and apply are mutually exclusive")
+	}
+
+	pvs, err := listInTreePVs(ctx, client, names)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, pv := range pvs {
+		if err := migratePV(ctx, client, out, opts, pv); err != nil {
+			klog.Errorf("failed to migrate PV %s: %v", pv.Name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to migrate %d of %d PVs", failed, len(pvs))
+	}
+	return nil
+}
+
+func listInTreePVs(ctx context.Context, client kubernetes.Interface, names []string) ([]*v1.PersistentVolume, error) {
+	var pvs []*v1.PersistentVolume
+	if len(names) == 0 {
+		list, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list PVs: %w", err)
+		}
+		for i := range list.Items {
+			if IsInTreeGlusterPV(&list.Items[i]) {
+				pvs = append(pvs, &list.Items[i])
+			}
+		}
+		return pvs, nil
+	}
+
+	for _, name := range names {
+		pv, err := client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get PV %s: %w", name, err)
+		}
+		if !IsInTreeGlusterPV(pv) {
+			return nil, fmt.Errorf("PV %s is not an in-tree glusterfs PV", name)
+		}
+		pvs = append(pvs, pv)
+	}
+	return pvs, nil
+}
+
+func migratePV(ctx context.Context, client kubernetes.Interface, out io.Writer, opts *MigrateOptions, pv *v1.PersistentVolume) error {
+	ns := InTreeEndpointsNamespace(pv)
+	if ns == "" {
+		return errors.New("endpoints namespace is not set and the PV is not bound to a claim")
+	}
+	ep, err := client.CoreV1().Endpoints(ns).Get(ctx, pv.Spec.Glusterfs.EndpointsName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get endpoints %s/%s: %w", ns, pv.Spec.Glusterfs.EndpointsName, err)
+	}
+
+	csiPV, err := TranslateInTreePV(pv, ep)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case opts.DryRun:
+		return printPVDiff(out, pv, csiPV)
+	case opts.Apply:
+		return replacePV(ctx, client, out, pv, csiPV, opts.Timeout)
+	default:
+		return printPV(out, csiPV)
+	}
+}
+
+func printPV(out io.Writer, pv *v1.PersistentVolume) error {
+	data, err := yaml.Marshal(pv)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "---\n%s", data)
+	return err
+}
+
+func printPVDiff(out io.Writer, pv, csiPV *v1.PersistentVolume) error {
+	// keep the same metadata as the translation so the diff only shows
+	// the fields that change
+	old := pv.DeepCopy()
+	old.TypeMeta = csiPV.TypeMeta
+	old.ObjectMeta = metav1.ObjectMeta{
+		Name:        old.Name,
+		Labels:      old.Labels,
+		Annotations: old.Annotations,
+	}
+	old.Status = v1.PersistentVolumeStatus{}
+
+	oldData, err := yaml.Marshal(old)
+	if err != nil {
+		return err
+	}
+	newData, err := yaml.Marshal(csiPV)
+	if err != nil {
+		return err
+	}
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(oldData)),
+		B:        difflib.SplitLines(string(newData)),
+		FromFile: pv.Name + " (in-tree)",
+		ToFile:   pv.Name + " (csi)",
+		Context:  3,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(out, diff)
+	return err
+}
+
+// replacePV deletes the in-tree PV and creates its translation under the same
+// name. The in-tree PV is switched to Retain first so that deleting it never
+// touches the gluster volume. The translation is written to out before the
+// in-tree PV is deleted, so it can be created by hand if anything fails later.
+func replacePV(ctx context.Context, client kubernetes.Interface, out io.Writer, pv, csiPV *v1.PersistentVolume, timeout time.Duration) error {
+	if pv.Spec.ClaimRef != nil {
+		pod, err := podUsingClaim(ctx, client, pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+		if err != nil {
+			return err
+		}
+		if pod != "" {
+			return fmt.Errorf("claim %s/%s is in use by pod %s, stop it before migrating", pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name, pod)
+		}
+	}
+
+	pvs := client.CoreV1().PersistentVolumes()
+	if err := retainPV(ctx, client, pv.Name); err != nil {
+		return fmt.Errorf("failed to set Retain reclaim policy: %w", err)
+	}
+
+	if err := printPV(out, csiPV); err != nil {
+		return fmt.Errorf("failed to write CSI PV manifest: %w", err)
+	}
+	if err := pvs.Delete(ctx, pv.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete in-tree PV: %w", err)
+	}
+	// The PV protection controller keeps a Bound PV in Terminating until
+	// it is released, which never happens here. No pod uses the claim, so
+	// drop the finalizer ourselves.
+	if err := removePVProtectionFinalizer(ctx, client, pv.Name); err != nil {
+		return fmt.Errorf("failed to remove %s finalizer: %w", pvProtectionFinalizer, err)
+	}
+	err := wait.PollUntilContextTimeout(ctx, time.Second, timeout, true, func(ctx context.Context) (bool, error) {
+		_, err := pvs.Get(ctx, pv.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for in-tree PV to be deleted: %w", err)
+	}
+
+	if _, err := pvs.Create(ctx, csiPV, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create CSI PV, apply the manifest written above by hand: %w", err)
+	}
+	klog.Infof("migrated PV %s to %s", pv.Name, csiPV.Spec.CSI.Driver)
+	return nil
+}
+
+// retainPV switches the named PV to the Retain reclaim policy.
+func retainPV(ctx context.Context, client kubernetes.Interface, name string) error {
+	pvs := client.CoreV1().PersistentVolumes()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pv, err := pvs.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimRetain {
+			return nil
+		}
+		pv.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimRetain
+		_, err = pvs.Update(ctx, pv, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// removePVProtectionFinalizer removes the PV protection finalizer from the
+// named PV, if the PV still exists.
+func removePVProtectionFinalizer(ctx context.Context, client kubernetes.Interface, name string) error {
+	pvs := client.CoreV1().PersistentVolumes()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pv, err := pvs.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var finalizers []string
+		for _, f := range pv.Finalizers {
+			if f != pvProtectionFinalizer {
+				finalizers = append(finalizers, f)
+			}
+		}
+		if len(finalizers) == len(pv.Finalizers) {
+			return nil
+		}
+		pv.Finalizers = finalizers
+		_, err = pvs.Update(ctx, pv, metav1.UpdateOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// podUsingClaim returns the name of a running pod in namespace that mounts
+// the claim, or an empty string if there is none.
+func podUsingClaim(ctx context.Context, client kubernetes.Interface, namespace, claim string) (string, error) {
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to list pods in %s: %w", namespace, err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, vol := range pod.Spec.Volumes {
+			if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == claim {
+				return pod.Name, nil
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,341 @@
+package glusterfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+func newInTreePV(endpointsNamespace *string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "pv1",
+			ResourceVersion: "42",
+			Annotations:     map[string]string{provisionedByAnnotation: "kubernetes.io/glusterfs"},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				Glusterfs: &v1.GlusterfsPersistentVolumeSource{
+					EndpointsName:      "glusterfs-cluster",
+					EndpointsNamespace: endpointsNamespace,
+					Path:               "vol1",
+					ReadOnly:           true,
+				},
+			},
+			ClaimRef:                      &v1.ObjectReference{Namespace: "app", Name: "data", UID: "uid1", ResourceVersion: "7"},
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			MountOptions:                  []string{"log-level=WARNING"},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: v1.VolumeBound},
+	}
+}
+
+func newEndpoints(ips ...string) *v1.Endpoints {
+	var addrs []v1.EndpointAddress
+	for _, ip := range ips {
+		addrs = append(addrs, v1.EndpointAddress{IP: ip})
+	}
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "glusterfs-cluster"},
+		Subsets:    []v1.EndpointSubset{{Addresses: addrs}},
+	}
+}
+
+func TestInTreeEndpointsNamespace(t *testing.T) {
+	gluster := "gluster"
+	assert.Equal(t, "gluster", InTreeEndpointsNamespace(newInTreePV(&gluster)))
+	assert.Equal(t, "app", InTreeEndpointsNamespace(newInTreePV(nil)))
+
+	pv := newInTreePV(nil)
+	pv.Spec.ClaimRef = nil
+	assert.Equal(t, "", InTreeEndpointsNamespace(pv))
+}
+
+func TestTranslateInTreePV(t *testing.T) {
+	pv := newInTreePV(nil)
+	out, err := TranslateInTreePV(pv, newEndpoints("10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	assert.NoError(t, err)
+
+	assert.Nil(t, out.Spec.Glusterfs)
+	assert.Equal(t, &v1.CSIPersistentVolumeSource{
+		Driver:       glusterfsCSIDriverName,
+		VolumeHandle: "pv1",
+		ReadOnly:     true,
+		VolumeAttributes: map[string]string{
+			glusterServerKey:        "10.0.0.1",
+			glusterVolumeKey:        "vol1",
+			glusterBackupServersKey: "10.0.0.2:10.0.0.3",
+		},
+	}, out.Spec.CSI)
+	assert.Equal(t, "pv1", out.Name)
+	assert.Empty(t, out.ResourceVersion)
+	assert.NotContains(t, out.Annotations, provisionedByAnnotation)
+	assert.Equal(t, v1.PersistentVolumeReclaimRetain, out.Spec.PersistentVolumeReclaimPolicy)
+	assert.Equal(t, []string{"log-level=WARNING"}, out.Spec.MountOptions)
+	assert.Equal(t, "uid1", string(out.Spec.ClaimRef.UID))
+	assert.Empty(t, out.Spec.ClaimRef.ResourceVersion)
+	assert.Empty(t, out.Status.Phase)
+
+	// the source PV must be left untouched
+	assert.NotNil(t, pv.Spec.Glusterfs)
+	assert.Contains(t, pv.Annotations, provisionedByAnnotation)
+	assert.Equal(t, "7", pv.Spec.ClaimRef.ResourceVersion)
+}
+
+func TestTranslateInTreePVDuplicateAddresses(t *testing.T) {
+	ep := newEndpoints("10.0.0.1", "10.0.0.2")
+	ep.Subsets = append(ep.Subsets, newEndpoints("10.0.0.2", "10.0.0.1", "10.0.0.3").Subsets...)
+
+	out, err := TranslateInTreePV(newInTreePV(nil), ep)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", out.Spec.CSI.VolumeAttributes[glusterServerKey])
+	assert.Equal(t, "10.0.0.2:10.0.0.3", out.Spec.CSI.VolumeAttributes[glusterBackupServersKey])
+}
+
+func TestTranslateInTreePVIgnoresHostname(t *testing.T) {
+	ep := newEndpoints("10.0.0.1")
+	ep.Subsets[0].Addresses[0].Hostname = "gluster-0"
+	ep.Subsets[0].Addresses = append(ep.Subsets[0].Addresses, v1.EndpointAddress{Hostname: "gluster-1"})
+
+	out, err := TranslateInTreePV(newInTreePV(nil), ep)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", out.Spec.CSI.VolumeAttributes[glusterServerKey])
+	assert.NotContains(t, out.Spec.CSI.VolumeAttributes, glusterBackupServersKey)
+}
+
+func TestTranslateInTreePVErrors(t *testing.T) {
+	_, err := TranslateInTreePV(newInTreePV(nil), newEndpoints("10.0.0.1", "fd00::1"))
+	assert.Error(t, err)
+
+	_, err = TranslateInTreePV(newInTreePV(nil), newEndpoints())
+	assert.Error(t, err)
+
+	_, err = TranslateInTreePV(newInTreePV(nil), nil)
+	assert.Error(t, err)
+
+	pv := newInTreePV(nil)
+	pv.Spec.Glusterfs.Path = "/"
+	_, err = TranslateInTreePV(pv, newEndpoints("10.0.0.1"))
+	assert.Error(t, err)
+
+	pv = newInTreePV(nil)
+	pv.Spec.Glusterfs = nil
+	_, err = TranslateInTreePV(pv, newEndpoints("10.0.0.1"))
+	assert.Error(t, err)
+}
+
+func newPodUsingClaim(namespace, claim string, phase v1.PodPhase) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "app-0"},
+		Spec: v1.PodSpec{
+			Volumes: []v1.Volume{{
+				Name: "data",
+				VolumeSource: v1.VolumeSource{
+					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+				},
+			}},
+		},
+		Status: v1.PodStatus{Phase: phase},
+	}
+}
+
+// pvActions returns the verbs of the actions the fake client recorded on
+// persistentvolumes, in order.
+func pvActions(client *fake.Clientset) []string {
+	var verbs []string
+	for _, a := range client.Actions() {
+		if a.GetResource().Resource == "persistentvolumes" {
+			verbs = append(verbs, a.GetVerb())
+		}
+	}
+	return verbs
+}
+
+func TestMigrateInTreePVsApply(t *testing.T) {
+	client := fake.NewSimpleClientset(newInTreePV(nil), newEndpoints("10.0.0.1", "10.0.0.2"))
+	opts := &MigrateOptions{Apply: true, Timeout: time.Second}
+
+	err := MigrateInTreePVs(context.Background(), client, io.Discard, opts, nil)
+	assert.NoError(t, err)
+
+	// Retain must be set before the delete, and the CSI PV created after it
+	assert.Equal(t, []string{"list", "get", "update", "delete", "get", "get", "create"}, pvActions(client))
+	for _, a := range client.Actions() {
+		if a.GetVerb() == "update" && a.GetResource().Resource == "persistentvolumes" {
+			update := a.(k8stesting.UpdateAction)
+			pv := update.GetObject().(*v1.PersistentVolume)
+			assert.Equal(t, v1.PersistentVolumeReclaimRetain, pv.Spec.PersistentVolumeReclaimPolicy)
+			assert.NotNil(t, pv.Spec.Glusterfs)
+		}
+	}
+
+	pv, err := client.CoreV1().PersistentVolumes().Get(context.Background(), "pv1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, pv.Spec.Glusterfs)
+	assert.Equal(t, glusterfsCSIDriverName, pv.Spec.CSI.Driver)
+}
+
+func TestMigrateInTreePVsApplyCreateFails(t *testing.T) {
+	client := fake.NewSimpleClientset(newInTreePV(nil), newEndpoints("10.0.0.1"))
+	client.PrependReactor("create", "persistentvolumes", func(a k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("create failed")
+	})
+	var out bytes.Buffer
+	opts := &MigrateOptions{Apply: true, Timeout: time.Second}
+
+	err := MigrateInTreePVs(context.Background(), client, &out, opts, nil)
+	assert.Error(t, err)
+
+	// the in-tree PV is gone, the manifest is all that is left to recover it
+	_, err = client.CoreV1().PersistentVolumes().Get(context.Background(), "pv1", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	var written v1.PersistentVolume
+	assert.NoError(t, yaml.Unmarshal(bytes.TrimPrefix(out.Bytes(), []byte("---\n")), &written))
+	assert.Equal(t, "pv1", written.Name)
+	assert.Equal(t, glusterfsCSIDriverName, written.Spec.CSI.Driver)
+	assert.Equal(t, "10.0.0.1", written.Spec.CSI.VolumeAttributes[glusterServerKey])
+}
+
+func TestMigrateInTreePVsApplyRetainConflict(t *testing.T) {
+	client := fake.NewSimpleClientset(newInTreePV(nil), newEndpoints("10.0.0.1"))
+	conflicts := 1
+	client.PrependReactor("update", "persistentvolumes", func(a k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts == 0 {
+			return false, nil, nil
+		}
+		conflicts--
+		return true, nil, apierrors.NewConflict(v1.Resource("persistentvolumes"), "pv1", errors.New("object was modified"))
+	})
+	opts := &MigrateOptions{Apply: true, Timeout: time.Second}
+
+	err := MigrateInTreePVs(context.Background(), client, io.Discard, opts, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"list", "get", "update", "get", "update", "delete", "get", "get", "create"}, pvActions(client))
+}
+
+// addPVFinalizerReactors makes the fake client honour finalizers on PV
+// deletion, the way the API server does.
+func addPVFinalizerReactors(client *fake.Clientset) {
+	gvr := v1.SchemeGroupVersion.WithResource("persistentvolumes")
+	client.PrependReactor("delete", "persistentvolumes", func(a k8stesting.Action) (bool, runtime.Object, error) {
+		obj, err := client.Tracker().Get(gvr, "", a.(k8stesting.DeleteAction).GetName())
+		if err != nil {
+			return false, nil, nil
+		}
+		pv := obj.(*v1.PersistentVolume)
+		if len(pv.Finalizers) == 0 {
+			return false, nil, nil
+		}
+		now := metav1.Now()
+		pv.DeletionTimestamp = &now
+		return true, nil, client.Tracker().Update(gvr, pv, "")
+	})
+	client.PrependReactor("update", "persistentvolumes", func(a k8stesting.Action) (bool, runtime.Object, error) {
+		pv := a.(k8stesting.UpdateAction).GetObject().(*v1.PersistentVolume)
+		if pv.DeletionTimestamp == nil || len(pv.Finalizers) > 0 {
+			return false, nil, nil
+		}
+		return true, pv, client.Tracker().Delete(gvr, "", pv.Name)
+	})
+}
+
+func TestMigrateInTreePVsApplyProtectedPV(t *testing.T) {
+	pv := newInTreePV(nil)
+	pv.Finalizers = []string{pvProtectionFinalizer}
+	client := fake.NewSimpleClientset(pv, newEndpoints("10.0.0.1"))
+	addPVFinalizerReactors(client)
+	opts := &MigrateOptions{Apply: true, Timeout: time.Second}
+
+	err := MigrateInTreePVs(context.Background(), client, io.Discard, opts, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"list", "get", "update", "delete", "get", "update", "get", "create"}, pvActions(client))
+
+	pv, err = client.CoreV1().PersistentVolumes().Get(context.Background(), "pv1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, pv.DeletionTimestamp)
+	assert.Equal(t, glusterfsCSIDriverName, pv.Spec.CSI.Driver)
+}
+
+func TestMigrateInTreePVsApplyClaimInUse(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newInTreePV(nil),
+		newEndpoints("10.0.0.1"),
+		newPodUsingClaim("app", "data", v1.PodRunning),
+	)
+	opts := &MigrateOptions{Apply: true, Timeout: time.Second}
+
+	err := MigrateInTreePVs(context.Background(), client, io.Discard, opts, []string{"pv1"})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"get"}, pvActions(client))
+
+	pv, err := client.CoreV1().PersistentVolumes().Get(context.Background(), "pv1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotNil(t, pv.Spec.Glusterfs)
+	assert.Equal(t, v1.PersistentVolumeReclaimDelete, pv.Spec.PersistentVolumeReclaimPolicy)
+}
+
+func TestMigrateInTreePVsApplyCompletedPod(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newInTreePV(nil),
+		newEndpoints("10.0.0.1"),
+		newPodUsingClaim("app", "data", v1.PodSucceeded),
+	)
+	opts := &MigrateOptions{Apply: true, Timeout: time.Second}
+
+	err := MigrateInTreePVs(context.Background(), client, io.Discard, opts, nil)
+	assert.NoError(t, err)
+}
+
+func TestMigrateInTreePVsDryRun(t *testing.T) {
+	pv := newInTreePV(nil)
+	pv.UID = "pv-uid"
+	pv.CreationTimestamp = metav1.Now()
+	pv.Finalizers = []string{pvProtectionFinalizer}
+	client := fake.NewSimpleClientset(pv, newEndpoints("10.0.0.1"))
+	var out bytes.Buffer
+
+	err := MigrateInTreePVs(context.Background(), client, &out, &MigrateOptions{DryRun: true}, nil)
+	assert.NoError(t, err)
+	assert.NotContains(t, out.String(), "uid: pv-uid")
+	assert.NotContains(t, out.String(), "creationTimestamp: \"20")
+	assert.NotContains(t, out.String(), pvProtectionFinalizer)
+	assert.NotContains(t, out.String(), "resourceVersion: \"42\"")
+	// the provisioned-by annotation is really dropped
+	assert.Contains(t, out.String(), "-    "+provisionedByAnnotation)
+	assert.Contains(t, out.String(), "--- pv1 (in-tree)")
+	assert.Contains(t, out.String(), "+++ pv1 (csi)")
+	assert.Contains(t, out.String(), "-  glusterfs:")
+	assert.Contains(t, out.String(), "+    driver: "+glusterfsCSIDriverName)
+	assert.Equal(t, []string{"list"}, pvActions(client))
+}
+
+func TestMigrateInTreePVsEmit(t *testing.T) {
+	client := fake.NewSimpleClientset(newInTreePV(nil), newEndpoints("10.0.0.1"))
+	var out bytes.Buffer
+
+	err := MigrateInTreePVs(context.Background(), client, &out, &MigrateOptions{}, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "kind: PersistentVolume")
+	assert.Contains(t, out.String(), "driver: "+glusterfsCSIDriverName)
+	assert.Equal(t, []string{"list"}, pvActions(client))
+}
+
+func TestMigrateInTreePVsDryRunAndApply(t *testing.T) {
+	client := fake.NewSimpleClientset(newInTreePV(nil), newEndpoints("10.0.0.1"))
+
+	err := MigrateInTreePVs(context.Background(), client, io.Discard, &MigrateOptions{DryRun: true, Apply: true}, nil)
+	assert.Error(t, err)
+	assert.Empty(t, client.Actions())
+}
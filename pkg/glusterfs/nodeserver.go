@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
@@ -19,6 +20,18 @@ import (
 type NodeServer struct {
 	*Driver
 	mounter mount.Interface
+
+	// publishedVolumes maps every target path published on this node to
+	// its gluster mount source and access mode, so single writer access
+	// modes can be enforced. It is rebuilt from the mount table on start.
+	publishMutex     sync.Mutex
+	publishedVolumes map[string]publishedVolume
+}
+
+type publishedVolume struct {
+	source string
+	// mode is UNKNOWN for mounts found in the mount table on start
+	mode csi.VolumeCapability_AccessMode_Mode
 }
 
 var glusterMounter = mount.New("")
@@ -33,6 +46,8 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	}
 
 	targetPath := req.GetTargetPath()
+	source := getMountSource(req.GetVolumeContext())
+	mode := req.GetVolumeCapability().GetAccessMode().GetMode()
 
 	notMnt, err := glusterMounter.IsLikelyNotMountPoint(targetPath)
 
@@ -48,27 +63,47 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 	}
 
+	if err = ns.reservePublishPath(req.GetVolumeId(), source, targetPath, mode); err != nil {
+		return nil, err
+	}
+
 	if !notMnt {
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
 	mo := req.GetVolumeCapability().GetMount().GetMountFlags()
 
-	if req.GetReadonly() {
+	// activated snapshots are served by glusterd as read-only volumes
+	isSnapshot := req.GetVolumeContext()[glusterSnapshotKey] != ""
+	if req.GetReadonly() || isSnapshot {
 		mo = append(mo, "ro")
 	}
-	gs := req.GetVolumeContext()["glusterserver"]
 
-	ep := req.GetVolumeContext()["glustervol"]
-	source := fmt.Sprintf("%s:%s", gs, ep)
+	if bkp := req.GetVolumeContext()[glusterBackupServersKey]; bkp != "" {
+		mo = append(mo, "backup-volfile-servers="+bkp)
+	}
+
 	err = doMount(source, targetPath, mo)
 	if err != nil {
+		ns.releasePublishPath(targetPath)
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// getMountSource returns the glusterfs mount source for the volume context.
+// When a snapshot name is present the activated snapshot volfile is mounted
+// instead of the volume itself.
+func getMountSource(volCtx map[string]string) string {
+	gs := volCtx[glusterServerKey]
+	ep := volCtx[glusterVolumeKey]
+	if snap := volCtx[glusterSnapshotKey]; snap != "" {
+		return fmt.Sprintf("%s:/snaps/%s/%s", gs, snap, strings.TrimPrefix(ep, "/"))
+	}
+	return fmt.Sprintf("%s:%s", gs, ep)
+}
+
 func doMount(source, targetPath string, mo []string) error {
 	err := glusterMounter.Mount(source, targetPath, "glusterfs", mo)
 	if err != nil {
@@ -104,9 +139,97 @@ func (ns *NodeServer) validateNodePublishVolumeReq(req *csi.NodePublishVolumeReq
 	if req.GetVolumeCapability() == nil {
 		return status.Error(codes.InvalidArgument, "NodePublishVolume Volume Capability must be provided")
 	}
+
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return status.Error(codes.InvalidArgument, "NodePublishVolume Block access type is not supported")
+	}
+
+	mode := req.GetVolumeCapability().GetAccessMode().GetMode()
+	if _, ok := csi.VolumeCapability_AccessMode_Mode_name[int32(mode)]; !ok || mode == csi.VolumeCapability_AccessMode_UNKNOWN {
+		return status.Errorf(codes.InvalidArgument, "NodePublishVolume Access Mode %v is not supported", mode)
+	}
+
+	// snapshots can only be mounted read-only, fail here rather than on
+	// the first write
+	if req.GetVolumeContext()[glusterSnapshotKey] != "" && !req.GetReadonly() &&
+		mode != csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY &&
+		mode != csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY {
+		return status.Errorf(codes.InvalidArgument, "NodePublishVolume snapshot %s requires a read-only access mode", req.GetVolumeContext()[glusterSnapshotKey])
+	}
+	return nil
+}
+
+// reservePublishPath records targetPath as a publish target of source. It
+// fails when the same gluster source is published to a different target path
+// on this node and either publish is SINGLE_NODE_SINGLE_WRITER. Mounts of
+// unknown mode are treated as single writer.
+func (ns *NodeServer) reservePublishPath(volumeID, source, targetPath string, mode csi.VolumeCapability_AccessMode_Mode) error {
+	ns.publishMutex.Lock()
+	defer ns.publishMutex.Unlock()
+
+	if ns.publishedVolumes == nil {
+		ns.publishedVolumes = map[string]publishedVolume{}
+	}
+	source = normalizeMountSource(source)
+
+	for p, pv := range ns.publishedVolumes {
+		if pv.source != source || p == targetPath {
+			continue
+		}
+		if mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER ||
+			pv.mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER ||
+			pv.mode == csi.VolumeCapability_AccessMode_UNKNOWN {
+			return status.Errorf(codes.FailedPrecondition, "volume %s is already published at %s", volumeID, p)
+		}
+	}
+	ns.publishedVolumes[targetPath] = publishedVolume{source: source, mode: mode}
+	return nil
+}
+
+// releasePublishPath forgets targetPath as a publish target.
+func (ns *NodeServer) releasePublishPath(targetPath string) {
+	ns.publishMutex.Lock()
+	defer ns.publishMutex.Unlock()
+
+	delete(ns.publishedVolumes, targetPath)
+}
+
+// loadPublishedPaths records the glusterfs mounts already present on the
+// node, so volumes published before a restart are still accounted for. Their
+// access mode is not known.
+func (ns *NodeServer) loadPublishedPaths() error {
+	mps, err := ns.mounter.List()
+	if err != nil {
+		return err
+	}
+
+	ns.publishMutex.Lock()
+	defer ns.publishMutex.Unlock()
+
+	if ns.publishedVolumes == nil {
+		ns.publishedVolumes = map[string]publishedVolume{}
+	}
+	for _, mp := range mps {
+		if mp.Type == "glusterfs" || mp.Type == "fuse.glusterfs" {
+			ns.publishedVolumes[mp.Path] = publishedVolume{
+				source: normalizeMountSource(mp.Device),
+				mode:   csi.VolumeCapability_AccessMode_UNKNOWN,
+			}
+		}
+	}
 	return nil
 }
 
+// normalizeMountSource strips the optional leading slash of the volume in a
+// server:volume mount source, which the mount table may report either way.
+func normalizeMountSource(source string) string {
+	i := strings.Index(source, ":")
+	if i < 0 {
+		return source
+	}
+	return source[:i+1] + strings.TrimPrefix(source[i+1:], "/")
+}
+
 // NodeUnpublishVolume unmounts the volume from the target path
 func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	if req == nil {
@@ -125,6 +248,7 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	notMnt, err := glusterMounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
+			ns.releasePublishPath(targetPath)
 			return nil, status.Error(codes.NotFound, "targetpath not found")
 		}
 		return nil, status.Error(codes.Internal, err.Error())
@@ -132,6 +256,8 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	}
 
 	if notMnt {
+		// unmounted behind our back, e.g. by a crashed fuse client
+		ns.releasePublishPath(targetPath)
 		return nil, status.Error(codes.NotFound, "volume not mounted")
 	}
 
@@ -139,20 +265,29 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	ns.releasePublishPath(targetPath)
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 // NodeGetInfo returns NodeGetInfoResponse for CO.
 func (ns *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	return &csi.NodeGetInfoResponse{
+	resp := &csi.NodeGetInfoResponse{
 		NodeId: ns.Driver.nodeID,
-	}, nil
+	}
+	if len(ns.Driver.topology) > 0 {
+		resp.AccessibleTopology = &csi.Topology{
+			Segments: ns.Driver.topology,
+		}
+	}
+	return resp, nil
 }
 
 // NodeGetCapabilities returns the supported capabilities of the node server
 func (ns *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	return &csi.NodeGetCapabilitiesResponse{}, nil
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: ns.Driver.nscap,
+	}, nil
 }
 
 // NodeStageVolume mounts the volume to a staging path on the node.
@@ -0,0 +1,340 @@
+package glusterfs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+func TestNodeGetInfo(t *testing.T) {
+	tests := []struct {
+		desc             string
+		topology         map[string]string
+		expectedTopology *csi.Topology
+	}{
+		{
+			desc:             "no topology",
+			expectedTopology: nil,
+		},
+		{
+			desc:     "zone and rack",
+			topology: map[string]string{topologyZoneKey: "zone-a", topologyRackKey: "rack-1"},
+			expectedTopology: &csi.Topology{
+				Segments: map[string]string{topologyZoneKey: "zone-a", topologyRackKey: "rack-1"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		d := NewEmptyDriver("")
+		d.topology = test.topology
+		ns := NewNodeServer(d, nil)
+		resp, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, fakeNodeID, resp.NodeId, test.desc)
+		assert.Equal(t, test.expectedTopology, resp.AccessibleTopology, test.desc)
+	}
+}
+
+func TestGetMountSource(t *testing.T) {
+	tests := []struct {
+		desc     string
+		volCtx   map[string]string
+		expected string
+	}{
+		{
+			desc:     "volume",
+			volCtx:   map[string]string{glusterServerKey: "10.0.0.1", glusterVolumeKey: "vol1"},
+			expected: "10.0.0.1:vol1",
+		},
+		{
+			desc:     "snapshot",
+			volCtx:   map[string]string{glusterServerKey: "10.0.0.1", glusterVolumeKey: "vol1", glusterSnapshotKey: "snap1"},
+			expected: "10.0.0.1:/snaps/snap1/vol1",
+		},
+		{
+			desc:     "snapshot with leading slash in volume",
+			volCtx:   map[string]string{glusterServerKey: "10.0.0.1", glusterVolumeKey: "/vol1", glusterSnapshotKey: "snap1"},
+			expected: "10.0.0.1:/snaps/snap1/vol1",
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getMountSource(test.volCtx), test.desc)
+	}
+}
+
+func TestValidateNodePublishVolumeReq(t *testing.T) {
+	mountCap := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	tests := []struct {
+		desc         string
+		cap          *csi.VolumeCapability
+		expectedCode codes.Code
+	}{
+		{
+			desc:         "multi node multi writer",
+			cap:          mountCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+			expectedCode: codes.OK,
+		},
+		{
+			desc:         "single node single writer",
+			cap:          mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER),
+			expectedCode: codes.OK,
+		},
+		{
+			desc:         "unknown access mode",
+			cap:          mountCap(csi.VolumeCapability_AccessMode_UNKNOWN),
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "missing access mode",
+			cap:          &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc: "block access type",
+			cap: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+
+	ns := NewNodeServer(NewEmptyDriver(""), nil)
+	for _, test := range tests {
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "vol1",
+			TargetPath:       "/target",
+			VolumeCapability: test.cap,
+		}
+		err := ns.validateNodePublishVolumeReq(req)
+		assert.Equal(t, test.expectedCode, status.Code(err), test.desc)
+	}
+}
+
+func TestReservePublishPath(t *testing.T) {
+	ns := NewNodeServer(NewEmptyDriver(""), nil)
+	rwop := csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER
+	rwx := csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+
+	assert.NoError(t, ns.reservePublishPath("vol1", "10.0.0.1:vol1", "/target1", rwop))
+	assert.NoError(t, ns.reservePublishPath("vol1", "10.0.0.1:vol1", "/target1", rwop))
+	err := ns.reservePublishPath("vol1", "10.0.0.1:vol1", "/target2", rwop)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	ns.releasePublishPath("/target1")
+	assert.NoError(t, ns.reservePublishPath("vol1", "10.0.0.1:vol1", "/target2", rwop))
+
+	assert.NoError(t, ns.reservePublishPath("vol2", "10.0.0.1:vol2", "/target3", rwx))
+	assert.NoError(t, ns.reservePublishPath("vol2", "10.0.0.1:vol2", "/target4", rwx))
+	err = ns.reservePublishPath("vol2", "10.0.0.1:vol2", "/target5", rwop)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestReservePublishPathSingleWriterHeld(t *testing.T) {
+	ns := NewNodeServer(NewEmptyDriver(""), nil)
+	rwop := csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER
+
+	// a second static PV for the same gluster volume must not get around
+	// the single writer publish
+	assert.NoError(t, ns.reservePublishPath("pv1", "10.0.0.1:vol1", "/target1", rwop))
+	for _, mode := range []csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	} {
+		err := ns.reservePublishPath("pv2", "10.0.0.1:/vol1", "/target2", mode)
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err), mode.String())
+	}
+}
+
+func TestLoadPublishedPaths(t *testing.T) {
+	fakeMounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "10.0.0.1:/vol1", Path: "/target1", Type: "fuse.glusterfs"},
+		{Device: "/dev/sda1", Path: "/target2", Type: "ext4"},
+	})
+	ns := NewNodeServer(NewEmptyDriver(""), fakeMounter)
+	assert.NoError(t, ns.loadPublishedPaths())
+	assert.Equal(t, map[string]publishedVolume{
+		"/target1": {source: "10.0.0.1:vol1", mode: csi.VolumeCapability_AccessMode_UNKNOWN},
+	}, ns.publishedVolumes)
+
+	// the mode of a mount found on start is unknown, so it blocks any
+	// publish of the same source at another path
+	rwop := csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER
+	rwx := csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+	err := ns.reservePublishPath("vol1", "10.0.0.1:vol1", "/target3", rwop)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	err = ns.reservePublishPath("vol1", "10.0.0.1:vol1", "/target3", rwx)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.NoError(t, ns.reservePublishPath("vol1", "10.0.0.1:vol1", "/target1", rwop))
+}
+
+func TestNodePublishVolumeAlreadyMounted(t *testing.T) {
+	origMounter := glusterMounter
+	defer func() { glusterMounter = origMounter }()
+
+	mounted := t.TempDir()
+	fakeMounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "10.0.0.1:vol1", Path: mounted, Type: "fuse.glusterfs"},
+	})
+	glusterMounter = fakeMounter
+	ns := NewNodeServer(NewEmptyDriver(""), fakeMounter)
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   "vol1",
+		TargetPath: mounted,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER},
+		},
+		VolumeContext: map[string]string{glusterServerKey: "10.0.0.1", glusterVolumeKey: "vol1"},
+	}
+	_, err := ns.NodePublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+
+	// the already mounted path is tracked even though nothing was mounted
+	req.TargetPath = filepath.Join(t.TempDir(), "target")
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestNodePublishVolumeReadOnly(t *testing.T) {
+	rwx := csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+	rox := csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+	tests := []struct {
+		desc           string
+		readonly       bool
+		mode           csi.VolumeCapability_AccessMode_Mode
+		volCtx         map[string]string
+		expectedCode   codes.Code
+		expectedSource string
+		expectedRO     bool
+	}{
+		{
+			desc:           "volume",
+			mode:           rwx,
+			volCtx:         map[string]string{glusterServerKey: "10.0.0.1", glusterVolumeKey: "vol1"},
+			expectedSource: "10.0.0.1:vol1",
+			expectedRO:     false,
+		},
+		{
+			desc:           "readonly volume",
+			readonly:       true,
+			mode:           rwx,
+			volCtx:         map[string]string{glusterServerKey: "10.0.0.1", glusterVolumeKey: "vol1"},
+			expectedSource: "10.0.0.1:vol1",
+			expectedRO:     true,
+		},
+		{
+			desc:           "snapshot with reader only access mode",
+			mode:           rox,
+			volCtx:         map[string]string{glusterServerKey: "10.0.0.1", glusterVolumeKey: "vol1", glusterSnapshotKey: "snap1"},
+			expectedSource: "10.0.0.1:/snaps/snap1/vol1",
+			expectedRO:     true,
+		},
+		{
+			desc:           "readonly snapshot with writer access mode",
+			readonly:       true,
+			mode:           rwx,
+			volCtx:         map[string]string{glusterServerKey: "10.0.0.1", glusterVolumeKey: "vol1", glusterSnapshotKey: "snap1"},
+			expectedSource: "10.0.0.1:/snaps/snap1/vol1",
+			expectedRO:     true,
+		},
+		{
+			desc:         "writable snapshot",
+			mode:         rwx,
+			volCtx:       map[string]string{glusterServerKey: "10.0.0.1", glusterVolumeKey: "vol1", glusterSnapshotKey: "snap1"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:           "empty snapshot name",
+			mode:           rwx,
+			volCtx:         map[string]string{glusterServerKey: "10.0.0.1", glusterVolumeKey: "vol1", glusterSnapshotKey: ""},
+			expectedSource: "10.0.0.1:vol1",
+			expectedRO:     false,
+		},
+	}
+
+	origMounter := glusterMounter
+	defer func() { glusterMounter = origMounter }()
+
+	for _, test := range tests {
+		fakeMounter := mount.NewFakeMounter(nil)
+		glusterMounter = fakeMounter
+		ns := NewNodeServer(NewEmptyDriver(""), fakeMounter)
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:   "vol1",
+			TargetPath: filepath.Join(t.TempDir(), "target"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: test.mode},
+			},
+			Readonly:      test.readonly,
+			VolumeContext: test.volCtx,
+		}
+		_, err := ns.NodePublishVolume(context.Background(), req)
+		assert.Equal(t, test.expectedCode, status.Code(err), test.desc)
+		if test.expectedCode != codes.OK {
+			assert.Empty(t, fakeMounter.MountPoints, test.desc)
+			continue
+		}
+		if assert.Len(t, fakeMounter.MountPoints, 1, test.desc) {
+			mp := fakeMounter.MountPoints[0]
+			assert.Equal(t, test.expectedSource, mp.Device, test.desc)
+			if test.expectedRO {
+				assert.Contains(t, mp.Opts, "ro", test.desc)
+			} else {
+				assert.NotContains(t, mp.Opts, "ro", test.desc)
+			}
+		}
+	}
+}
+
+func TestNodeGetCapabilities(t *testing.T) {
+	d := NewDriver(&DriverOptions{NodeID: fakeNodeID, DriverName: DefaultDriverName})
+	ns := NewNodeServer(d, nil)
+	resp, err := ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	assert.NoError(t, err)
+
+	var caps []csi.NodeServiceCapability_RPC_Type
+	for _, c := range resp.Capabilities {
+		caps = append(caps, c.GetRpc().GetType())
+	}
+	assert.Contains(t, caps, csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER)
+	assert.NotContains(t, caps, csi.NodeServiceCapability_RPC_GET_VOLUME_STATS)
+}
+
+func TestNodeUnpublishVolumeReleasesStalePath(t *testing.T) {
+	origMounter := glusterMounter
+	defer func() { glusterMounter = origMounter }()
+
+	fakeMounter := mount.NewFakeMounter(nil)
+	glusterMounter = fakeMounter
+	ns := NewNodeServer(NewEmptyDriver(""), fakeMounter)
+	rwop := csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER
+
+	unmounted := t.TempDir()
+	missing := filepath.Join(t.TempDir(), "missing")
+	for _, target := range []string{unmounted, missing} {
+		assert.NoError(t, ns.reservePublishPath("vol1", "10.0.0.1:vol1", target, rwop))
+		_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   "vol1",
+			TargetPath: target,
+		})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+		assert.NotContains(t, ns.publishedVolumes, target)
+	}
+}